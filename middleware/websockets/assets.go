@@ -0,0 +1,14 @@
+package websockets
+
+import _ "embed"
+
+// clientHTML is the browser terminal bundle template served at a
+// Client-enabled endpoint's path for plain GET requests. It's
+// embedded straight from assets/index.html at build time, so the
+// served page and the source file on disk can never drift out of
+// sync. It contains a WS_PROTOCOL placeholder that renderClientHTML
+// fills in with the endpoint's configured subprotocol before serving
+// it.
+//
+//go:embed assets/index.html
+var clientHTML []byte
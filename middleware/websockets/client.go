@@ -0,0 +1,44 @@
+package websockets
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// clientProtocolPlaceholder is the quoted string literal in
+// clientHTML that renderClientHTML replaces with the endpoint's
+// actual configured subprotocol.
+const clientProtocolPlaceholder = `"__WS_PROTOCOL__"`
+
+// serveClient writes the embedded browser terminal bundle for plain
+// GET requests to a Client-enabled endpoint, so pointing a browser at
+// the endpoint works without requiring a hand-written frontend. It
+// reports whether it handled the request; callers should fall through
+// to the normal WebSocket upgrade when it returns false.
+func (ws WebSocket) serveClient(w http.ResponseWriter, r *http.Request) bool {
+	if !ws.Client || r.Method != http.MethodGet || isWebsocketUpgrade(r) {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(renderClientHTML(ws.Protocol))
+	return true
+}
+
+// renderClientHTML fills clientHTML's subprotocol placeholder with
+// protocol, so the served page always requests the endpoint's actual
+// configured WebSocket subprotocol instead of a hardcoded one. If
+// protocol is empty, the client negotiates no subprotocol at all and
+// falls back to the unframed wire format, matching how handshake
+// treats an endpoint with no Protocol configured.
+func renderClientHTML(protocol string) []byte {
+	quoted, _ := json.Marshal(protocol)
+	return bytes.Replace(clientHTML, []byte(clientProtocolPlaceholder), quoted, 1)
+}
+
+// isWebsocketUpgrade reports whether r is asking to upgrade to WebSocket.
+func isWebsocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
@@ -0,0 +1,49 @@
+package websockets
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderClientHTMLSubstitutesConfiguredProtocol(t *testing.T) {
+	out := string(renderClientHTML("gotty"))
+	if strings.Contains(out, clientProtocolPlaceholder) {
+		t.Error("renderClientHTML left the placeholder unreplaced")
+	}
+	if !strings.Contains(out, `"gotty"`) {
+		t.Error("renderClientHTML did not substitute the configured protocol")
+	}
+}
+
+func TestRenderClientHTMLEmptyProtocolRunsUnframed(t *testing.T) {
+	out := string(renderClientHTML(""))
+	if !strings.Contains(out, `var WS_PROTOCOL = "";`) {
+		t.Error("renderClientHTML with an empty protocol should serve WS_PROTOCOL = \"\"")
+	}
+}
+
+func TestServeClientServesOnlyGetToClientEnabledEndpoints(t *testing.T) {
+	ws := WebSocket{WSConfig: WSConfig{Client: true, Protocol: "gotty"}}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	if !ws.serveClient(w, r) {
+		t.Fatal("serveClient() = false, want true for a plain GET to a Client-enabled endpoint")
+	}
+	if !strings.Contains(w.Body.String(), `"gotty"`) {
+		t.Error("served page does not reference the endpoint's configured protocol")
+	}
+
+	upgrade := httptest.NewRequest("GET", "/", nil)
+	upgrade.Header.Set("Upgrade", "websocket")
+	upgrade.Header.Set("Connection", "Upgrade")
+	if ws.serveClient(httptest.NewRecorder(), upgrade) {
+		t.Error("serveClient() = true for a WebSocket upgrade request, want it to fall through")
+	}
+
+	disabled := WebSocket{WSConfig: WSConfig{Client: false}}
+	if disabled.serveClient(httptest.NewRecorder(), r) {
+		t.Error("serveClient() = true for a Client-disabled endpoint, want false")
+	}
+}
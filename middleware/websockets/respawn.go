@@ -0,0 +1,80 @@
+package websockets
+
+import "time"
+
+const (
+	// initialRespawnBackoff is how long to wait before the first
+	// restart of a crashed command.
+	initialRespawnBackoff = 100 * time.Millisecond
+
+	// defaultRespawnBackoffCap is the backoff ceiling used when
+	// WSConfig.RespawnBackoffCap isn't set.
+	defaultRespawnBackoffCap = 5 * time.Second
+
+	// defaultRespawnMax is the restart budget used when
+	// WSConfig.RespawnMax isn't set.
+	defaultRespawnMax = 10
+
+	// respawnResetThreshold is how long a run has to stay alive
+	// before the backoff and restart count are reset to their
+	// starting values.
+	respawnResetThreshold = 10 * time.Second
+)
+
+// respawnSupervisor tracks exponential backoff and restart budget
+// across successive relaunches of a single Command.
+type respawnSupervisor struct {
+	backoffCap time.Duration
+	max        int
+
+	backoff  time.Duration
+	restarts int
+}
+
+// newRespawnSupervisor builds a supervisor using ws's configured
+// limits, falling back to sane defaults when unset. A negative
+// RespawnMax or RespawnBackoffCap means "not configured"; zero is a
+// deliberate, meaningful choice (respectively: never restart, and
+// never wait between restarts) and must not be treated the same way.
+func newRespawnSupervisor(ws WebSocket) *respawnSupervisor {
+	cap := ws.RespawnBackoffCap
+	if cap < 0 {
+		cap = defaultRespawnBackoffCap
+	}
+	max := ws.RespawnMax
+	if max < 0 {
+		max = defaultRespawnMax
+	}
+	backoff := initialRespawnBackoff
+	if backoff > cap {
+		backoff = cap
+	}
+	return &respawnSupervisor{backoffCap: cap, max: max, backoff: backoff}
+}
+
+// next reports whether another restart is allowed given that the
+// previous run stayed alive for ranFor, and if so, how long to wait
+// before starting it. A run that stayed alive past
+// respawnResetThreshold resets the backoff and restart count, so a
+// command that's generally healthy doesn't slowly exhaust its budget.
+func (s *respawnSupervisor) next(ranFor time.Duration) (wait time.Duration, ok bool) {
+	if ranFor >= respawnResetThreshold {
+		s.backoff = initialRespawnBackoff
+		if s.backoff > s.backoffCap {
+			s.backoff = s.backoffCap
+		}
+		s.restarts = 0
+	}
+
+	s.restarts++
+	if s.restarts > s.max {
+		return 0, false
+	}
+
+	wait = s.backoff
+	s.backoff *= 2
+	if s.backoff > s.backoffCap {
+		s.backoff = s.backoffCap
+	}
+	return wait, true
+}
@@ -0,0 +1,72 @@
+package websockets
+
+import "testing"
+
+func TestRespawnSupervisorBacksOffExponentiallyUpToCap(t *testing.T) {
+	sup := &respawnSupervisor{backoffCap: 1000, max: 10, backoff: 10}
+
+	wantWaits := []int{10, 20, 40, 80, 160, 320, 640, 1000, 1000}
+	for i, want := range wantWaits {
+		wait, ok := sup.next(0)
+		if !ok {
+			t.Fatalf("restart %d: next() = false, want true", i)
+		}
+		if int(wait) != want {
+			t.Errorf("restart %d: wait = %d, want %d", i, wait, want)
+		}
+	}
+}
+
+func TestRespawnSupervisorGivesUpAfterMax(t *testing.T) {
+	sup := &respawnSupervisor{backoffCap: 1000, max: 2, backoff: 10}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := sup.next(0); !ok {
+			t.Fatalf("restart %d: next() = false, want true", i)
+		}
+	}
+	if _, ok := sup.next(0); ok {
+		t.Error("next() = true after exhausting max restarts, want false")
+	}
+}
+
+func TestNewRespawnSupervisorTreatsExplicitZeroMaxAsNeverRestart(t *testing.T) {
+	ws := WebSocket{WSConfig: WSConfig{RespawnMax: 0, RespawnBackoffCap: -1}}
+	sup := newRespawnSupervisor(ws)
+	if _, ok := sup.next(0); ok {
+		t.Error("next() = true for an explicitly configured RespawnMax of 0, want false (never restart)")
+	}
+}
+
+func TestNewRespawnSupervisorDefaultsUnsetMax(t *testing.T) {
+	ws := WebSocket{WSConfig: WSConfig{RespawnMax: -1, RespawnBackoffCap: -1}}
+	sup := newRespawnSupervisor(ws)
+	if sup.max != defaultRespawnMax {
+		t.Errorf("max = %d, want defaultRespawnMax (%d) when RespawnMax is unset", sup.max, defaultRespawnMax)
+	}
+}
+
+func TestNewRespawnSupervisorTreatsExplicitZeroBackoffAsNoWait(t *testing.T) {
+	ws := WebSocket{WSConfig: WSConfig{RespawnMax: -1, RespawnBackoffCap: 0}}
+	sup := newRespawnSupervisor(ws)
+	wait, ok := sup.next(0)
+	if !ok {
+		t.Fatal("next() = false, want true")
+	}
+	if wait != 0 {
+		t.Errorf("wait = %v, want 0 for an explicitly configured RespawnBackoffCap of 0", wait)
+	}
+}
+
+func TestRespawnSupervisorResetsAfterHealthyRun(t *testing.T) {
+	sup := &respawnSupervisor{backoffCap: 1000, max: 1, backoff: 10}
+
+	if _, ok := sup.next(0); !ok {
+		t.Fatal("first next() = false, want true")
+	}
+	// A run that stayed up past the reset threshold should reset the
+	// restart budget, or this would report false (max is 1).
+	if _, ok := sup.next(respawnResetThreshold); !ok {
+		t.Error("next() after a healthy run = false, want true (budget should have reset)")
+	}
+}
@@ -0,0 +1,73 @@
+package websockets
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"path/filepath"
+)
+
+// checkTLS rejects the upgrade if this endpoint requires TLS and the
+// request didn't arrive over it.
+func (ws WebSocket) checkTLS(r *http.Request) error {
+	if ws.RequireTLS && r.TLS == nil {
+		return errors.New("websocket: TLS required")
+	}
+	return nil
+}
+
+// checkOrigin enforces this endpoint's origin allowlist. Requests
+// with no Origin header (i.e. not from a browser) are always
+// allowed. With AllowedOrigins unset, only a same-origin Origin
+// header is accepted; cross-origin upgrades are otherwise rejected
+// unless a configured pattern matches, or "allow_origin *" was set,
+// matching the posture gotty adopted after early CSRF issues.
+func (ws WebSocket) checkOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return errors.New("websocket: invalid Origin header")
+	}
+
+	if len(ws.AllowedOrigins) == 0 {
+		if u.Host == r.Host {
+			return nil
+		}
+		return errors.New("websocket: cross-origin request rejected")
+	}
+
+	for _, pattern := range ws.AllowedOrigins {
+		if pattern == "*" {
+			return nil
+		}
+		if matched, _ := filepath.Match(pattern, u.Host); matched {
+			return nil
+		}
+	}
+	return errors.New("websocket: origin not allowed: " + origin)
+}
+
+// checkBasicAuth enforces this endpoint's basic-auth credentials, if
+// BasicAuthUser is configured. Credentials are compared in constant
+// time so a timing side-channel can't be used to guess them byte by
+// byte.
+func (ws WebSocket) checkBasicAuth(r *http.Request) error {
+	if ws.BasicAuthUser == "" {
+		return nil
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok || !constantTimeEqual(user, ws.BasicAuthUser) || !constantTimeEqual(pass, ws.BasicAuthPass) {
+		return errors.New("websocket: basic auth failed")
+	}
+	return nil
+}
+
+// constantTimeEqual reports whether a and b are equal, taking time
+// independent of where they first differ.
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
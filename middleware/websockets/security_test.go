@@ -0,0 +1,96 @@
+package websockets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOriginNoHeaderAlwaysAllowed(t *testing.T) {
+	ws := WebSocket{WSConfig: WSConfig{}}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := ws.checkOrigin(r); err != nil {
+		t.Errorf("checkOrigin() = %v, want nil for a request with no Origin header", err)
+	}
+}
+
+func TestCheckOriginDefaultsToSameOrigin(t *testing.T) {
+	ws := WebSocket{WSConfig: WSConfig{}}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "example.com"
+	r.Header.Set("Origin", "http://example.com")
+	if err := ws.checkOrigin(r); err != nil {
+		t.Errorf("checkOrigin() = %v, want nil for a same-origin request", err)
+	}
+
+	r.Header.Set("Origin", "http://evil.example")
+	if err := ws.checkOrigin(r); err == nil {
+		t.Error("checkOrigin() = nil, want an error for a cross-origin request with no allowlist")
+	}
+}
+
+func TestCheckOriginAllowlistPatterns(t *testing.T) {
+	ws := WebSocket{WSConfig: WSConfig{AllowedOrigins: []string{"*.example.com"}}}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "unrelated.test"
+	r.Header.Set("Origin", "https://app.example.com")
+	if err := ws.checkOrigin(r); err != nil {
+		t.Errorf("checkOrigin() = %v, want nil for an origin matching the allowlist", err)
+	}
+
+	r.Header.Set("Origin", "https://app.other.com")
+	if err := ws.checkOrigin(r); err == nil {
+		t.Error("checkOrigin() = nil, want an error for an origin not matching the allowlist")
+	}
+}
+
+func TestCheckOriginWildcardAllowsAnything(t *testing.T) {
+	ws := WebSocket{WSConfig: WSConfig{AllowedOrigins: []string{"*"}}}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Origin", "https://anywhere.test")
+	if err := ws.checkOrigin(r); err != nil {
+		t.Errorf("checkOrigin() = %v, want nil when allow_origin * is set", err)
+	}
+}
+
+func TestCheckBasicAuthUnconfiguredAllowsAll(t *testing.T) {
+	ws := WebSocket{WSConfig: WSConfig{}}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := ws.checkBasicAuth(r); err != nil {
+		t.Errorf("checkBasicAuth() = %v, want nil when no BasicAuthUser is configured", err)
+	}
+}
+
+func TestCheckBasicAuthRequiresMatchingCredentials(t *testing.T) {
+	ws := WebSocket{WSConfig: WSConfig{BasicAuthUser: "alice", BasicAuthPass: "hunter2"}}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := ws.checkBasicAuth(r); err == nil {
+		t.Error("checkBasicAuth() = nil, want an error when no credentials were sent")
+	}
+
+	r.SetBasicAuth("alice", "wrong")
+	if err := ws.checkBasicAuth(r); err == nil {
+		t.Error("checkBasicAuth() = nil, want an error for a wrong password")
+	}
+
+	r.SetBasicAuth("alice", "hunter2")
+	if err := ws.checkBasicAuth(r); err != nil {
+		t.Errorf("checkBasicAuth() = %v, want nil for matching credentials", err)
+	}
+}
+
+func TestConstantTimeEqual(t *testing.T) {
+	if !constantTimeEqual("same", "same") {
+		t.Error("constantTimeEqual(\"same\", \"same\") = false, want true")
+	}
+	if constantTimeEqual("same", "diff") {
+		t.Error("constantTimeEqual(\"same\", \"diff\") = true, want false")
+	}
+	if constantTimeEqual("short", "muchlonger") {
+		t.Error("constantTimeEqual with mismatched lengths = true, want false")
+	}
+}
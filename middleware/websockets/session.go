@@ -0,0 +1,343 @@
+package websockets
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// scrollbackSize is how many trailing bytes of a shared session's
+// output are kept so that a client joining late can be caught up.
+const scrollbackSize = 64 * 1024
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = map[*WSConfig]*wsSession{}
+)
+
+// wsSession is a single long-lived Command execution backing a
+// share-mode websocket endpoint. Every connected client reads the
+// same broadcast output and, unless ReadOnly, writes to the same
+// stdin.
+type wsSession struct {
+	ws      WebSocket
+	cmd     *exec.Cmd
+	stdin   io.Writer
+	output  io.Reader
+	ptyFile *os.File // non-nil when WSConfig.PTY is set; needed to apply resizes
+
+	mu      sync.Mutex
+	clients map[*websocket.Conn]bool // value: whether that client negotiated the framed subprotocol
+	history *ringBuffer
+	dead    bool
+}
+
+// handleShared joins conn to the shared session for key, starting
+// the session's Command on the first connection to arrive.
+func (ws WebSocket) handleShared(conn *websocket.Conn, key *WSConfig) {
+	sess, err := sessionFor(ws, key)
+	if err != nil {
+		log.Println("[ERROR] websocket: share:", err)
+		return
+	}
+	sess.join(conn, ws.framed(conn))
+}
+
+// sessionFor returns the running session for key, lazily starting
+// one if this is the first client to arrive or the previous session
+// has been torn down. Respawn is not consulted here.
+func sessionFor(ws WebSocket, key *WSConfig) (*wsSession, error) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	if sess, ok := sessions[key]; ok {
+		return sess, nil
+	}
+
+	sess, err := newSession(ws)
+	if err != nil {
+		return nil, err
+	}
+	sessions[key] = sess
+	go sess.run(key)
+	return sess, nil
+}
+
+// newSession starts ws.Command, attaching it to a PTY if ws.PTY is set.
+func newSession(ws WebSocket) (*wsSession, error) {
+	cmd, stdin, stdout, master, err := ws.startProcess()
+	if err != nil {
+		return nil, err
+	}
+	return &wsSession{
+		ws:      ws,
+		cmd:     cmd,
+		stdin:   stdin,
+		output:  stdout,
+		ptyFile: master,
+		clients: make(map[*websocket.Conn]bool),
+		history: newRingBuffer(scrollbackSize),
+	}, nil
+}
+
+// run broadcasts the session's output to every connected client and
+// records it to the scrollback buffer until the command's output is
+// exhausted. If Respawn is set and clients are still connected once
+// the command exits, it's relaunched with backoff via the same
+// policy Handle uses; otherwise the session tears down.
+func (sess *wsSession) run(key *WSConfig) {
+	sup := newRespawnSupervisor(sess.ws)
+
+	for {
+		started := time.Now()
+		sess.pump()
+		sess.cmd.Wait()
+		if sess.ptyFile != nil {
+			sess.ptyFile.Close()
+		}
+
+		if !sess.ws.Respawn || !sess.hasClients() {
+			sess.teardown(key)
+			return
+		}
+
+		wait, ok := sup.next(time.Since(started))
+		if !ok {
+			sess.teardown(key)
+			return
+		}
+		sess.broadcastNotice("process exited; restarting...")
+		time.Sleep(wait)
+
+		cmd, stdin, stdout, master, err := sess.ws.startProcess()
+		if err != nil {
+			log.Println("[ERROR] websocket: share: respawn:", err)
+			sess.teardown(key)
+			return
+		}
+		sess.mu.Lock()
+		sess.cmd, sess.stdin, sess.output, sess.ptyFile = cmd, stdin, stdout, master
+		sess.mu.Unlock()
+	}
+}
+
+// pump copies the current process's output to the scrollback buffer
+// and every connected client until that process's output ends.
+func (sess *wsSession) pump() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := sess.output.Read(buf)
+		if n > 0 {
+			chunk := append([]byte(nil), buf[:n]...)
+			sess.history.Write(chunk)
+			sess.broadcast(chunk)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// hasClients reports whether any client is currently attached.
+func (sess *wsSession) hasClients() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return len(sess.clients) > 0
+}
+
+// broadcastNotice sends a one-time server-info frame with the given
+// title to every client that negotiated the framed subprotocol, e.g.
+// to announce a respawn.
+func (sess *wsSession) broadcastNotice(title string) {
+	info := mustJSON(wsServerInfo{Title: title})
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	for conn, framed := range sess.clients {
+		if framed {
+			writeFrame(conn, frameResize, info)
+		}
+	}
+}
+
+// broadcast writes chunk to every connected client, framed or raw as
+// each client negotiated.
+func (sess *wsSession) broadcast(chunk []byte) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	for conn, framed := range sess.clients {
+		if framed {
+			writeFrame(conn, frameOutput, chunk)
+		} else {
+			conn.Write(chunk)
+		}
+	}
+}
+
+// join attaches conn to the session: it's sent any scrollback, then
+// added as a client and blocks relaying its input until it or the
+// session closes. If the session has already died, conn only gets
+// the scrollback before being closed.
+func (sess *wsSession) join(conn *websocket.Conn, framed bool) {
+	sess.mu.Lock()
+	if sess.dead {
+		history := sess.history.Bytes()
+		sess.mu.Unlock()
+		sendHistory(conn, framed, history)
+		conn.Close()
+		return
+	}
+	sess.clients[conn] = framed
+	history := sess.history.Bytes()
+	sess.mu.Unlock()
+
+	sendHistory(conn, framed, history)
+
+	switch {
+	case framed:
+		readInputFramed(conn, sess.stdinFor(sess.ws.ReadOnly), sess.currentPTY)
+	case sess.ws.ReadOnly:
+		io.Copy(ioutil.Discard, conn)
+	default:
+		io.Copy(sess.stdinFor(false), conn)
+	}
+
+	sess.leave(conn)
+}
+
+// sessionStdinWriter writes to whichever process is currently backing
+// sess, re-reading sess.stdin under lock on every Write instead of
+// capturing it once at join time. Without that, a client that joined
+// before a respawn would keep writing to the exited process's closed
+// pipe forever.
+type sessionStdinWriter struct {
+	sess *wsSession
+}
+
+func (w sessionStdinWriter) Write(p []byte) (int, error) {
+	return w.sess.currentStdin().Write(p)
+}
+
+// stdinFor returns the writer framed input should be written to: the
+// shared session's current stdin (re-read on every write, so it
+// survives a respawn), or a discard writer for read-only clients.
+func (sess *wsSession) stdinFor(readOnly bool) io.Writer {
+	if readOnly {
+		return ioutil.Discard
+	}
+	return sessionStdinWriter{sess: sess}
+}
+
+// currentStdin returns the input writer for the process actually
+// running right now, read under sess.mu so a concurrent respawn is
+// observed instead of a stale value captured before it happened.
+func (sess *wsSession) currentStdin() io.Writer {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.stdin
+}
+
+// currentPTY returns the PTY master for the process actually running
+// right now, or nil if it isn't attached to one. Like currentStdin,
+// it's read under sess.mu on every call rather than captured once, so
+// a resize from a client that joined before a respawn reaches the new
+// process's PTY instead of the old one's closed fd.
+func (sess *wsSession) currentPTY() *os.File {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.ptyFile
+}
+
+// leave removes conn from the session and, if it was the last
+// client, kills the currently running command so the session tears
+// down.
+func (sess *wsSession) leave(conn *websocket.Conn) {
+	sess.mu.Lock()
+	delete(sess.clients, conn)
+	empty := len(sess.clients) == 0
+	cmd := sess.cmd
+	sess.mu.Unlock()
+
+	conn.Close()
+	if empty {
+		cmd.Process.Kill()
+	}
+}
+
+// teardown runs once the command has exited for good (run decided not
+// to, or couldn't, respawn it): it disconnects any remaining clients,
+// closes the PTY if any, and removes the session from the registry so
+// the next connection to this endpoint starts a fresh one, respecting
+// Respawn to decide whether that happened above or will happen lazily
+// on that next connect. A joiner that races this teardown still sees
+// dead and gets scrollback-then-close rather than the torn-down
+// session's stale streams.
+func (sess *wsSession) teardown(key *WSConfig) {
+	sess.mu.Lock()
+	sess.dead = true
+	clients := make([]*websocket.Conn, 0, len(sess.clients))
+	for conn := range sess.clients {
+		clients = append(clients, conn)
+	}
+	sess.mu.Unlock()
+
+	for _, conn := range clients {
+		conn.Close()
+	}
+	if sess.ptyFile != nil {
+		sess.ptyFile.Close()
+	}
+
+	sessionsMu.Lock()
+	delete(sessions, key)
+	sessionsMu.Unlock()
+}
+
+// sendHistory writes previously buffered scrollback to a newly
+// joined client, framed or raw as it negotiated.
+func sendHistory(conn *websocket.Conn, framed bool, history []byte) {
+	if len(history) == 0 {
+		return
+	}
+	if framed {
+		writeFrame(conn, frameOutput, history)
+	} else {
+		conn.Write(history)
+	}
+}
+
+// ringBuffer is a fixed-capacity byte buffer that keeps only the most
+// recently written bytes, used to give late joiners of a shared
+// session some scrollback.
+type ringBuffer struct {
+	mu   sync.Mutex
+	buf  []byte
+	size int
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{size: size}
+}
+
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf = append(r.buf, p...)
+	if len(r.buf) > r.size {
+		r.buf = r.buf[len(r.buf)-r.size:]
+	}
+	return len(p), nil
+}
+
+func (r *ringBuffer) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]byte, len(r.buf))
+	copy(out, r.buf)
+	return out
+}
@@ -0,0 +1,78 @@
+package websockets
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+// TestTeardownRemovesSessionRegardlessOfRespawn guards against the
+// registry leak where a non-respawning session's entry in the
+// package-level sessions map was never cleaned up, permanently wedging
+// the endpoint in the dead state instead of relaunching on next connect.
+func TestTeardownRemovesSessionRegardlessOfRespawn(t *testing.T) {
+	for _, respawn := range []bool{false, true} {
+		key := &WSConfig{Respawn: respawn}
+		sess := &wsSession{
+			ws:      WebSocket{WSConfig: *key},
+			clients: make(map[*websocket.Conn]bool),
+			history: newRingBuffer(scrollbackSize),
+		}
+
+		sessionsMu.Lock()
+		sessions[key] = sess
+		sessionsMu.Unlock()
+
+		sess.teardown(key)
+
+		sessionsMu.Lock()
+		_, stillRegistered := sessions[key]
+		sessionsMu.Unlock()
+		if stillRegistered {
+			t.Errorf("Respawn=%v: session still registered after teardown; next connect can never start a fresh one", respawn)
+		}
+		if !sess.dead {
+			t.Errorf("Respawn=%v: expected dead to be set", respawn)
+		}
+	}
+}
+
+// TestStdinWriterFollowsRespawn guards against a client that joined
+// before a respawn writing forever to the old process's closed pipe:
+// stdinFor must re-read sess.stdin on every write, not capture it once.
+func TestStdinWriterFollowsRespawn(t *testing.T) {
+	sess := &wsSession{}
+
+	var before bytes.Buffer
+	sess.stdin = &before
+	w := sess.stdinFor(false)
+
+	w.Write([]byte("to old process"))
+
+	var after bytes.Buffer
+	sess.mu.Lock()
+	sess.stdin = &after
+	sess.mu.Unlock()
+
+	w.Write([]byte("to respawned process"))
+
+	if before.String() != "to old process" {
+		t.Errorf("before.String() = %q, want %q", before.String(), "to old process")
+	}
+	if after.String() != "to respawned process" {
+		t.Errorf("after.String() = %q, want %q", after.String(), "to respawned process")
+	}
+}
+
+func TestRingBufferKeepsOnlyTrailingBytes(t *testing.T) {
+	r := newRingBuffer(4)
+	r.Write([]byte("abcdef"))
+	if got := string(r.Bytes()); got != "cdef" {
+		t.Errorf("Bytes() = %q, want %q", got, "cdef")
+	}
+	r.Write([]byte("gh"))
+	if got := string(r.Bytes()); got != "efgh" {
+		t.Errorf("Bytes() = %q, want %q", got, "efgh")
+	}
+}
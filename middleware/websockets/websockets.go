@@ -4,10 +4,19 @@
 package websockets
 
 import (
+	"encoding/json"
 	"errors"
+	"io"
+	"log"
 	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/flynn/go-shlex"
+	"github.com/kr/pty"
 	"github.com/mholt/caddy/middleware"
 	"golang.org/x/net/websocket"
 )
@@ -27,22 +36,79 @@ type (
 	// WSConfig holds the configuration for a single websocket
 	// endpoint which may serve multiple websocket connections.
 	WSConfig struct {
-		Path      string
-		Command   string
-		Arguments []string
-		Respawn   bool // TODO: Not used, but parser supports it until we decide on it
+		Path              string
+		Command           string
+		Arguments         []string
+		Respawn           bool          // If true, Command is relaunched with backoff when it exits while clients are connected
+		RespawnMax        int           // Maximum number of consecutive restarts before giving up, or 0 to never restart; negative means defaultRespawnMax
+		RespawnBackoffCap time.Duration // Ceiling for the exponential backoff between restarts, or 0 for no backoff; negative means defaultRespawnBackoffCap
+		PTY               bool          // If true, Command is attached to a pseudo-terminal instead of plain pipes
+		Protocol          string        // If set, negotiated as the WebSocket subprotocol and enables the framed wire format
+		Share             bool          // If true, all clients of this endpoint share a single Command instance
+		ReadOnly          bool          // In Share mode, if true this client's stdin is never written to the shared Command
+		AllowedOrigins    []string      // Origin host patterns (matched with filepath.Match) allowed to upgrade; "*" allows any. Empty means same-origin only
+		BasicAuthUser     string        // If set, upgrades must carry HTTP Basic credentials matching this user...
+		BasicAuthPass     string        // ...and this password
+		RequireTLS        bool          // If true, only upgrades made over TLS are accepted
+		Client            bool          // If true, a plain GET to Path serves an embedded browser terminal client
+	}
+
+	// WebSocket is the execution context for a single websocket
+	// connection: the endpoint configuration plus the HTTP
+	// request that initiated the upgrade.
+	WebSocket struct {
+		WSConfig
+		*http.Request
+	}
+
+	// wsSize is the payload of a resize control frame: the
+	// terminal dimensions the client wants the PTY set to.
+	wsSize struct {
+		Columns int `json:"columns"`
+		Rows    int `json:"rows"`
+	}
+
+	// wsServerInfo is sent as a type '1' server frame so the
+	// client can set a window title or otherwise show what it's
+	// connected to: by Handle each time Command starts, and to
+	// announce a restart or that restarts were given up.
+	wsServerInfo struct {
+		Title string `json:"title"`
 	}
 )
 
+// Frame types for the optional framed subprotocol. Each websocket
+// text message is a single type byte followed by its payload.
+const (
+	frameInput  = '0' // client -> server: bytes to write to stdin/PTY
+	frameResize = '1' // client -> server: JSON {"columns":N,"rows":M}; server -> client: JSON server info (on start, restart and give-up)
+	framePing   = '2' // client -> server: keepalive ping
+	frameOutput = '0' // server -> client: bytes read from stdout/PTY
+)
+
 // ServeHTTP converts the HTTP request to a WebSocket connection and serves it up.
 func (ws WebSockets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	for _, sockconfig := range ws.Sockets {
+	for i := range ws.Sockets {
+		sockconfig := &ws.Sockets[i]
 		if middleware.Path(r.URL.Path).Matches(sockconfig.Path) {
 			socket := WebSocket{
-				WSConfig: sockconfig,
+				WSConfig: *sockconfig,
 				Request:  r,
 			}
-			websocket.Handler(socket.Handle).ServeHTTP(w, r)
+			if socket.serveClient(w, r) {
+				return
+			}
+			server := websocket.Server{
+				Handshake: socket.handshake,
+				Handler: func(conn *websocket.Conn) {
+					if sockconfig.Share {
+						socket.handleShared(conn, sockconfig)
+					} else {
+						socket.Handle(conn)
+					}
+				},
+			}
+			server.ServeHTTP(w, r)
 			return
 		}
 	}
@@ -51,25 +117,408 @@ func (ws WebSockets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ws.Next(w, r)
 }
 
-// New constructs and configures a new websockets middleware instance.
-func New(c middleware.Controller) (middleware.Middleware, error) {
-	var websocks []WSConfig
-	var respawn bool
+// handshake enforces this endpoint's TLS, origin, and basic-auth
+// policy, then negotiates the WebSocket subprotocol. If this endpoint
+// has a Protocol configured and the client offered it in the
+// Sec-WebSocket-Protocol header, it's selected and the framed wire
+// format is used; otherwise the connection falls back to the
+// existing raw byte behavior, so clients that don't ask for the
+// subprotocol see no change.
+func (ws WebSocket) handshake(config *websocket.Config, r *http.Request) error {
+	if err := ws.checkTLS(r); err != nil {
+		return err
+	}
+	if err := ws.checkOrigin(r); err != nil {
+		return err
+	}
+	if err := ws.checkBasicAuth(r); err != nil {
+		return err
+	}
+
+	if ws.Protocol != "" {
+		for _, offered := range config.Protocol {
+			if offered == ws.Protocol {
+				config.Protocol = []string{offered}
+				return nil
+			}
+		}
+	}
+	config.Protocol = nil
+	return nil
+}
+
+// framed reports whether conn negotiated this endpoint's Protocol
+// and should therefore speak the typed control-frame subprotocol.
+func (ws WebSocket) framed(conn *websocket.Conn) bool {
+	if ws.Protocol == "" {
+		return false
+	}
+	negotiated := conn.Config().Protocol
+	return len(negotiated) > 0 && negotiated[0] == ws.Protocol
+}
+
+// startProcess launches Command (attached to a PTY if PTY is set)
+// and returns the streams Handle and wsSession use to talk to it.
+// master is non-nil (and equal to both stdin and stdout) only when
+// PTY is enabled; it's needed separately so callers can apply resize
+// requests to it.
+func (ws WebSocket) startProcess() (cmd *exec.Cmd, stdin io.Writer, stdout io.Reader, master *os.File, err error) {
+	cmd = exec.Command(ws.Command, ws.Arguments...)
+	cmd.Env = ws.env()
+
+	if ws.PTY {
+		master, err = pty.Start(cmd)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		return cmd, master, master, master, nil
+	}
 
-	optionalBlock := func() (hadBlock bool, err error) {
-		for c.NextBlock() {
-			hadBlock = true
-			if c.Val() == "respawn" {
-				respawn = true
+	stdout, err = cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	stdin, err = cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return cmd, stdin, stdout, nil, nil
+}
+
+// Handle executes the configured command and copies bytes between
+// the command's standard streams and the WebSocket connection until
+// the client disconnects or, when Respawn is not set, the command
+// exits, which closes the connection. If PTY is enabled, the command is attached
+// to a pseudo-terminal instead of plain OS pipes, so interactive
+// programs (shells, curses/TUI apps, anything that checks isatty)
+// behave correctly. If Respawn is set, Command is relaunched with
+// exponential backoff each time it exits while the client is still
+// connected, up to RespawnMax times.
+func (ws WebSocket) Handle(conn *websocket.Conn) {
+	framed := ws.framed(conn)
+
+	input := make(chan clientMsg)
+	go pumpClientInput(conn, framed, input)
+
+	var writeMu sync.Mutex
+	sup := newRespawnSupervisor(ws)
+
+	for {
+		cmd, stdin, stdout, master, err := ws.startProcess()
+		if err != nil {
+			log.Println("[ERROR] websocket: start:", err)
+			return
+		}
+		if framed {
+			writeMu.Lock()
+			writeFrame(conn, frameResize, mustJSON(wsServerInfo{Title: ws.Command}))
+			writeMu.Unlock()
+		}
+
+		started := time.Now()
+		procDone := make(chan struct{})
+		go func() {
+			copyOutputSafe(conn, stdout, framed, &writeMu)
+			close(procDone)
+		}()
+
+		for done := false; !done; {
+			select {
+			case msg, ok := <-input:
+				if !ok {
+					cmd.Process.Kill()
+					cmd.Wait()
+					if master != nil {
+						master.Close()
+					}
+					return
+				}
+				applyClientMsg(msg, stdin, master, func() {
+					writeMu.Lock()
+					writeFrame(conn, framePing, nil)
+					writeMu.Unlock()
+				})
+			case <-procDone:
+				done = true
+			}
+		}
+
+		cmd.Process.Kill()
+		cmd.Wait()
+		if master != nil {
+			master.Close()
+		}
+
+		if !ws.Respawn {
+			conn.Close()
+			return
+		}
+
+		wait, ok := sup.next(time.Since(started))
+		if !ok {
+			if framed {
+				writeMu.Lock()
+				writeFrame(conn, frameResize, mustJSON(wsServerInfo{Title: "process exited; giving up"}))
+				writeMu.Unlock()
+			}
+			conn.Close()
+			return
+		}
+		if framed {
+			writeMu.Lock()
+			writeFrame(conn, frameResize, mustJSON(wsServerInfo{Title: "process exited; restarting..."}))
+			writeMu.Unlock()
+		}
+		time.Sleep(wait)
+	}
+}
+
+// clientMsg is a single piece of input read from a client, either a
+// chunk of raw bytes (in which case Kind is frameInput) or a parsed
+// control frame.
+type clientMsg struct {
+	Kind byte
+	Data []byte
+}
+
+// pumpClientInput reads from conn until it closes, sending each chunk
+// of input to out. In framed mode, it reads and forwards whole typed
+// frames; otherwise it forwards raw byte chunks as frameInput
+// messages. out is closed when conn's read side ends, which Handle
+// uses as its signal that the client has disconnected.
+func pumpClientInput(conn *websocket.Conn, framed bool, out chan<- clientMsg) {
+	defer close(out)
+
+	if framed {
+		for {
+			typ, payload, err := readFrame(conn)
+			if err != nil {
+				return
+			}
+			out <- clientMsg{Kind: typ, Data: payload}
+		}
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			out <- clientMsg{Kind: frameInput, Data: append([]byte(nil), buf[:n]...)}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// applyClientMsg acts on a single message from pumpClientInput:
+// writing input to stdin, applying a resize to masterFile (if set),
+// or answering a ping via pong.
+func applyClientMsg(msg clientMsg, stdin io.Writer, masterFile *os.File, pong func()) {
+	switch msg.Kind {
+	case frameInput:
+		stdin.Write(msg.Data)
+	case frameResize:
+		if masterFile == nil {
+			return
+		}
+		var size wsSize
+		if err := json.Unmarshal(msg.Data, &size); err != nil {
+			return
+		}
+		pty.Setsize(masterFile, &pty.Winsize{
+			Rows: uint16(size.Rows),
+			Cols: uint16(size.Columns),
+		})
+	case framePing:
+		if pong != nil {
+			pong()
+		}
+	}
+}
+
+// copyOutputSafe reads from r until EOF, writing each chunk to conn
+// (framed or raw) under mu so it doesn't interleave with control
+// messages written from elsewhere.
+func copyOutputSafe(conn *websocket.Conn, r io.Reader, framed bool, mu *sync.Mutex) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			mu.Lock()
+			var werr error
+			if framed {
+				werr = writeFrame(conn, frameOutput, buf[:n])
 			} else {
-				return true, c.Err("Expected websocket configuration parameter in block")
+				_, werr = conn.Write(buf[:n])
+			}
+			mu.Unlock()
+			if werr != nil {
+				return
 			}
 		}
-		return
+		if err != nil {
+			return
+		}
 	}
+}
+
+// mustJSON marshals v, returning nil on the (practically impossible)
+// failure of one of the small structs defined in this package.
+func mustJSON(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// readInputFramed reads typed frames from conn until it closes,
+// writing type '0' payloads to stdin and, if ptyFile returns non-nil,
+// applying type '1' resize requests to it. ptyFile is called afresh
+// for every frame, rather than captured once, so a respawn happening
+// concurrently in the caller is picked up on the next resize. Type '2'
+// pings are answered with a pong of the same type. It's used by the
+// shared session handler, which doesn't need Handle's respawn
+// supervision.
+func readInputFramed(conn *websocket.Conn, stdin io.Writer, ptyFile func() *os.File) {
+	for {
+		typ, payload, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		applyClientMsg(clientMsg{Kind: typ, Data: payload}, stdin, ptyFile(), func() {
+			writeFrame(conn, framePing, nil)
+		})
+	}
+}
+
+// writeFrame sends a single framed text message: typ followed by payload.
+func writeFrame(conn *websocket.Conn, typ byte, payload []byte) error {
+	msg := make([]byte, 0, len(payload)+1)
+	msg = append(msg, typ)
+	msg = append(msg, payload...)
+	return websocket.Message.Send(conn, string(msg))
+}
+
+// readFrame receives a single framed text message and splits it into
+// its type byte and payload.
+func readFrame(conn *websocket.Conn) (byte, []byte, error) {
+	var msg string
+	if err := websocket.Message.Receive(conn, &msg); err != nil {
+		return 0, nil, err
+	}
+	if len(msg) == 0 {
+		return 0, nil, errors.New("websocket: empty frame")
+	}
+	return msg[0], []byte(msg[1:]), nil
+}
+
+// env returns the environment that Command should be run with: the
+// process environment plus a few CGI-like variables describing the
+// request that triggered this websocket connection.
+func (ws WebSocket) env() []string {
+	env := os.Environ()
+	if ws.Request != nil {
+		env = append(env,
+			"GATEWAY_INTERFACE="+GatewayInterface,
+			"SERVER_SOFTWARE="+ServerSoftware,
+			"REMOTE_ADDR="+ws.Request.RemoteAddr,
+			"REQUEST_URI="+ws.Request.RequestURI,
+		)
+	}
+	return env
+}
+
+// New constructs and configures a new websockets middleware instance.
+func New(c middleware.Controller) (middleware.Middleware, error) {
+	var websocks []WSConfig
 
 	for c.Next() {
+		// All of these are scoped per-directive so a block that
+		// doesn't set one of them doesn't silently inherit it from
+		// the previous websocket block in the Caddyfile.
 		var val, path, command string
+		var respawn bool
+		respawnMax := -1                       // -1 means not configured; 0 is a deliberate "never restart"
+		respawnBackoffCap := time.Duration(-1) // -1 means not configured; 0 is a deliberate "never wait"
+		var usePTY bool
+		var protocol string
+		var share bool
+		var readOnly bool
+		var allowedOrigins []string
+		var basicAuthUser, basicAuthPass string
+		var requireTLS bool
+		var client bool
+
+		optionalBlock := func() (hadBlock bool, err error) {
+			for c.NextBlock() {
+				hadBlock = true
+				switch c.Val() {
+				case "respawn":
+					respawn = true
+					// Optional nested block: respawn { max N backoff 5s }
+					for c.NextBlock() {
+						switch c.Val() {
+						case "max":
+							if !c.NextArg() {
+								return true, c.ArgErr()
+							}
+							n, err := strconv.Atoi(c.Val())
+							if err != nil {
+								return true, c.Err("Invalid max value for respawn: " + err.Error())
+							}
+							respawnMax = n
+						case "backoff":
+							if !c.NextArg() {
+								return true, c.ArgErr()
+							}
+							d, err := time.ParseDuration(c.Val())
+							if err != nil {
+								return true, c.Err("Invalid backoff value for respawn: " + err.Error())
+							}
+							respawnBackoffCap = d
+						default:
+							return true, c.Err("Expected max or backoff in respawn block")
+						}
+					}
+				case "pty":
+					usePTY = true
+				case "protocol":
+					if !c.NextArg() {
+						return true, c.ArgErr()
+					}
+					protocol = c.Val()
+				case "share":
+					share = true
+				case "readonly":
+					readOnly = true
+				case "allow_origin":
+					for c.NextArg() {
+						allowedOrigins = append(allowedOrigins, c.Val())
+					}
+					if len(allowedOrigins) == 0 {
+						return true, c.ArgErr()
+					}
+				case "basicauth":
+					if !c.NextArg() {
+						return true, c.ArgErr()
+					}
+					basicAuthUser = c.Val()
+					if !c.NextArg() {
+						return true, c.ArgErr()
+					}
+					basicAuthPass = c.Val()
+				case "require_tls":
+					requireTLS = true
+				case "client":
+					client = true
+				default:
+					return true, c.Err("Expected websocket configuration parameter in block")
+				}
+			}
+			return
+		}
 
 		// Path or command; not sure which yet
 		if !c.NextArg() {
@@ -107,10 +556,21 @@ func New(c middleware.Controller) (middleware.Middleware, error) {
 		}
 
 		websocks = append(websocks, WSConfig{
-			Path:      path,
-			Command:   cmd,
-			Arguments: args,
-			Respawn:   respawn,
+			Path:              path,
+			Command:           cmd,
+			Arguments:         args,
+			Respawn:           respawn,
+			RespawnMax:        respawnMax,
+			RespawnBackoffCap: respawnBackoffCap,
+			PTY:               usePTY,
+			Protocol:          protocol,
+			Share:             share,
+			ReadOnly:          readOnly,
+			AllowedOrigins:    allowedOrigins,
+			BasicAuthUser:     basicAuthUser,
+			BasicAuthPass:     basicAuthPass,
+			RequireTLS:        requireTLS,
+			Client:            client,
 		})
 	}
 
@@ -0,0 +1,87 @@
+package websockets
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+// withWSConn spins up a websocket echo-free server and hands fn both
+// ends of a live connection, so readFrame/writeFrame can be exercised
+// against the real wire format instead of a hand-rolled stand-in.
+func withWSConn(t *testing.T, fn func(server, client *websocket.Conn)) {
+	t.Helper()
+
+	serverConn := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		serverConn <- ws
+		<-ws.Request().Context().Done()
+	}))
+	defer srv.Close()
+
+	origin := "http://" + srv.Listener.Addr().String() + "/"
+	url := "ws://" + srv.Listener.Addr().String() + "/"
+	client, err := websocket.Dial(url, "", origin)
+	if err != nil {
+		t.Fatalf("websocket.Dial: %v", err)
+	}
+	defer client.Close()
+
+	fn(<-serverConn, client)
+}
+
+func TestWriteFrameThenReadFrameRoundTrips(t *testing.T) {
+	withWSConn(t, func(server, client *websocket.Conn) {
+		if err := writeFrame(server, frameOutput, []byte("some output")); err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+		typ, payload, err := readFrame(client)
+		if err != nil {
+			t.Fatalf("readFrame: %v", err)
+		}
+		if typ != frameOutput {
+			t.Errorf("typ = %q, want %q", typ, frameOutput)
+		}
+		if string(payload) != "some output" {
+			t.Errorf("payload = %q, want %q", payload, "some output")
+		}
+	})
+}
+
+func TestReadFrameRejectsEmptyMessage(t *testing.T) {
+	withWSConn(t, func(server, client *websocket.Conn) {
+		if err := websocket.Message.Send(server, ""); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if _, _, err := readFrame(client); err == nil {
+			t.Error("readFrame on an empty message = nil error, want one")
+		}
+	})
+}
+
+func TestApplyClientMsgInput(t *testing.T) {
+	var stdin bytes.Buffer
+	applyClientMsg(clientMsg{Kind: frameInput, Data: []byte("hello")}, &stdin, nil, nil)
+	if stdin.String() != "hello" {
+		t.Errorf("stdin = %q, want %q", stdin.String(), "hello")
+	}
+}
+
+func TestApplyClientMsgResizeWithoutPTYIsNoop(t *testing.T) {
+	var stdin bytes.Buffer
+	// Should not panic when masterFile is nil, e.g. a non-PTY endpoint.
+	applyClientMsg(clientMsg{Kind: frameResize, Data: []byte(`{"columns":80,"rows":24}`)}, &stdin, nil, nil)
+	if stdin.Len() != 0 {
+		t.Errorf("stdin = %q, want empty", stdin.String())
+	}
+}
+
+func TestApplyClientMsgPing(t *testing.T) {
+	var pinged bool
+	applyClientMsg(clientMsg{Kind: framePing}, nil, nil, func() { pinged = true })
+	if !pinged {
+		t.Error("pong callback was not invoked for a ping frame")
+	}
+}